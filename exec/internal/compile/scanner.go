@@ -10,6 +10,100 @@ import (
 
 type scanner struct {
 	supportedOpcodes map[byte]bool
+	policy           Policy
+}
+
+// NewScanner creates a scanner which selects candidates for native
+// compilation from the given supported opcode set, scoring them against
+// policy. Backends should start from DefaultPolicy and override whichever
+// weights reflect their own call/JIT overhead.
+func NewScanner(supportedOpcodes map[byte]bool, policy Policy) *scanner {
+	return &scanner{
+		supportedOpcodes: supportedOpcodes,
+		policy:           policy,
+	}
+}
+
+// Policy tunes which CompilationCandidate runs are worth handing off to a
+// native backend. Short runs of cheap stack shuffling (get_local/set_local)
+// cost more to call into native code for than they save, so ScanFunc scores
+// every candidate and drops the ones below MinScore.
+type Policy struct {
+	// MinOps is the fewest instructions a run of supported opcodes needs
+	// before it is even considered as a candidate.
+	MinOps int
+
+	// MinIntegerFloatRatio is the minimum fraction of a candidate's
+	// instructions that must be counted as IntegerOps or FloatOps.
+	// ScanFunc counts get_local/set_local as IntegerOps, so this does not
+	// reject stack traffic; the fraction drops below 1 only for supported
+	// opcodes that ScanFunc's switch does not account for.
+	MinIntegerFloatRatio float64
+
+	// CallOverhead estimates the fixed cost of transferring control to
+	// native code and back, in the same units as the op weights below.
+	CallOverhead float64
+
+	// IntegerOpWeight, FloatOpWeight and MemoryOpWeight estimate the
+	// native-code savings of an integer op, a float op and a memory
+	// read/write respectively. StackOpWeight estimates the cost of a
+	// stack read/write, which native code still has to perform.
+	IntegerOpWeight float64
+	FloatOpWeight   float64
+	MemoryOpWeight  float64
+	StackOpWeight   float64
+
+	// MinScore is the minimum score (see scoreCandidate) a candidate
+	// must reach to be selected for native compilation.
+	MinScore float64
+}
+
+// DefaultPolicy is a conservative starting point for backends: it requires
+// runs of at least 3 supported opcodes, at least half of them counted as
+// integer or float ops, whose estimated savings clear a small fixed call
+// overhead.
+var DefaultPolicy = Policy{
+	MinOps:               3,
+	MinIntegerFloatRatio: 0.5,
+	CallOverhead:         2,
+	IntegerOpWeight:      1,
+	FloatOpWeight:        1,
+	MemoryOpWeight:       1,
+	StackOpWeight:        0.25,
+	MinScore:             1,
+}
+
+// scoreCandidate estimates the native-code savings of compiling c, following
+// the policy's weights. Candidates that don't clear MinScore are not worth
+// the overhead of a call into native code.
+func (p *Policy) scoreCandidate(c CompilationCandidate) float64 {
+	m := c.Metrics
+	return p.IntegerOpWeight*float64(m.IntegerOps) +
+		p.FloatOpWeight*float64(m.FloatOps) +
+		p.MemoryOpWeight*float64(m.MemoryReads+m.MemoryWrites) -
+		p.CallOverhead -
+		p.StackOpWeight*float64(m.StackReads+m.StackWrites)
+}
+
+// selectCandidate reports whether c is worth compiling to native code under
+// the policy: it must meet the minimum op count and integer/float ratio, and
+// its estimated savings must clear MinScore.
+func (p *Policy) selectCandidate(c CompilationCandidate) bool {
+	if c.Metrics.AllOps == 0 {
+		// Nothing was ever accumulated - this is a freshly reset/empty
+		// candidate, not a real run, regardless of MinOps.
+		return false
+	}
+	if c.Metrics.AllOps < p.MinOps {
+		return false
+	}
+	if p.MinIntegerFloatRatio > 0 {
+		ratio := float64(c.Metrics.IntegerOps+c.Metrics.FloatOps) / float64(c.Metrics.AllOps)
+		if ratio < p.MinIntegerFloatRatio {
+			return false
+		}
+	}
+	return p.scoreCandidate(c) >= p.MinScore
 }
 
 // InstructionMetadata describes a bytecode instruction.
@@ -31,6 +125,18 @@ type CompilationCandidate struct {
 	StartInstruction int     // InstructionMeta index of the first instruction.
 	EndInstruction   int     // InstructionMeta index of the last instruction.
 	Metrics          Metrics // Metrics about the instructions between first & last index.
+
+	// EntryOffsets lists the bytecode offsets within [Start, End) that
+	// other parts of the function branch into - the backend must emit a
+	// label or entry stub at each offset so those branches can jump
+	// straight into the native code instead of falling back to the
+	// interpreter. A candidate's Start ends up here whenever it is
+	// itself an InboundTarget other than offset 0, whether the candidate was opened by
+	// splitting a run mid-way (see ScanFunc) or opened fresh right after
+	// an unsupported opcode reset it. As implemented, that's always at
+	// most a single offset: any further InboundTarget reached mid-run
+	// forces another split rather than appending to this slice.
+	EntryOffsets []uint
 }
 
 func (s *CompilationCandidate) reset() {
@@ -39,6 +145,7 @@ func (s *CompilationCandidate) reset() {
 	s.StartInstruction = 0
 	s.EndInstruction = 1
 	s.Metrics = Metrics{}
+	s.EntryOffsets = nil
 }
 
 // Bounds returns the beginning & end index in the bytecode which
@@ -64,58 +171,115 @@ func (s *scanner) ScanFunc(bytecode []byte, meta *BytecodeMetadata) ([]Compilati
 	inProgress := CompilationCandidate{}
 
 	for i, inst := range meta.Instructions {
-		// Except for the first instruction, we cant emit a native section
-		// where other parts of code try and call into us halfway. Maybe we
-		// can support that in the future.
 		_, hasInboundTarget := meta.InboundTargets[int64(inst.Start)]
-		isInsideBranchTarget := hasInboundTarget && inst.Start > 0 && inProgress.Metrics.AllOps > 0
+		// isBranchTarget is true whenever something else in the function
+		// branches into this instruction - whether or not we happen to
+		// have a candidate in progress right now. That's independent of
+		// isInsideBranchTarget below, which only cares about whether the
+		// run needs to be split.
+		isBranchTarget := hasInboundTarget && inst.Start > 0
+		isInsideBranchTarget := isBranchTarget && inProgress.Metrics.AllOps > 0
 
-		if !s.supportedOpcodes[inst.Op] || isInsideBranchTarget {
+		if !s.supportedOpcodes[inst.Op] {
 			// See if the candidate can be emitted.
-			if inProgress.Metrics.AllOps > 2 {
+			if s.policy.selectCandidate(inProgress) {
 				finishedCandidates = append(finishedCandidates, inProgress)
 			}
 			inProgress.reset()
 			continue
 		}
 
+		if isInsideBranchTarget {
+			// Other parts of the code branch into this instruction, so we
+			// can't keep emitting it as the middle of the current native
+			// section - there'd be no valid entry point there. Close the
+			// candidate off here and immediately open a new one starting
+			// at this instruction instead, so the two adjacent native
+			// regions can be joined by a local jump rather than falling
+			// all the way back to the interpreter.
+			if s.policy.selectCandidate(inProgress) {
+				finishedCandidates = append(finishedCandidates, inProgress)
+			}
+			inProgress.reset()
+		}
+
 		// Still a supported run.
 
 		if inProgress.Metrics.AllOps == 0 {
 			// First instruction of the candidate - setup structure.
 			inProgress.Start = uint(inst.Start)
 			inProgress.StartInstruction = i
+			if isBranchTarget {
+				inProgress.EntryOffsets = append(inProgress.EntryOffsets, uint(inst.Start))
+			}
 		}
 		inProgress.EndInstruction = i + 1
 		inProgress.End = uint(inst.Start) + uint(inst.Size)
 
 		// TODO: Add to this table as backends support more opcodes.
 		switch inst.Op {
-		case ops.I64Const, ops.GetLocal:
+		case ops.I32Const, ops.I64Const, ops.GetLocal:
 			inProgress.Metrics.IntegerOps++
 			inProgress.Metrics.StackWrites++
+		case ops.F32Const, ops.F64Const:
+			inProgress.Metrics.FloatOps++
+			inProgress.Metrics.StackWrites++
 		case ops.SetLocal:
 			inProgress.Metrics.IntegerOps++
 			inProgress.Metrics.StackReads++
-		case ops.I64Eqz:
+		case ops.I32Eqz, ops.I64Eqz:
 			inProgress.Metrics.IntegerOps++
 			inProgress.Metrics.StackReads++
 			inProgress.Metrics.StackWrites++
 
-		case ops.I64Eq, ops.I64Ne, ops.I64LtU, ops.I64GtU, ops.I64LeU, ops.I64GeU,
+		case ops.I32Eq, ops.I32Ne, ops.I32LtU, ops.I32GtU, ops.I32LeU, ops.I32GeU,
+			ops.I32Shl, ops.I32ShrU, ops.I32ShrS,
+			ops.I32DivU, ops.I32RemU, ops.I32DivS, ops.I32RemS,
+			ops.I32Add, ops.I32Sub, ops.I32Mul, ops.I32And, ops.I32Or, ops.I32Xor,
+			ops.I64Eq, ops.I64Ne, ops.I64LtU, ops.I64GtU, ops.I64LeU, ops.I64GeU,
 			ops.I64Shl, ops.I64ShrU, ops.I64ShrS,
 			ops.I64DivU, ops.I64RemU, ops.I64DivS, ops.I64RemS,
 			ops.I64Add, ops.I64Sub, ops.I64Mul, ops.I64And, ops.I64Or, ops.I64Xor:
 			inProgress.Metrics.IntegerOps++
 			inProgress.Metrics.StackReads += 2
 			inProgress.Metrics.StackWrites++
+
+		case ops.F32Eq, ops.F32Ne, ops.F32Lt, ops.F32Gt, ops.F32Le, ops.F32Ge,
+			ops.F32Add, ops.F32Sub, ops.F32Mul, ops.F32Div,
+			ops.F64Eq, ops.F64Ne, ops.F64Lt, ops.F64Gt, ops.F64Le, ops.F64Ge,
+			ops.F64Add, ops.F64Sub, ops.F64Mul, ops.F64Div:
+			inProgress.Metrics.FloatOps++
+			inProgress.Metrics.StackReads += 2
+			inProgress.Metrics.StackWrites++
+
+		case ops.I32Load, ops.I32Load8s, ops.I32Load8u, ops.I32Load16s, ops.I32Load16u,
+			ops.I64Load, ops.I64Load8s, ops.I64Load8u, ops.I64Load16s, ops.I64Load16u, ops.I64Load32s, ops.I64Load32u:
+			inProgress.Metrics.IntegerOps++
+			inProgress.Metrics.MemoryReads++
+			inProgress.Metrics.StackReads++
+			inProgress.Metrics.StackWrites++
+		case ops.F32Load, ops.F64Load:
+			inProgress.Metrics.FloatOps++
+			inProgress.Metrics.MemoryReads++
+			inProgress.Metrics.StackReads++
+			inProgress.Metrics.StackWrites++
+
+		case ops.I32Store, ops.I32Store8, ops.I32Store16,
+			ops.I64Store, ops.I64Store8, ops.I64Store16, ops.I64Store32:
+			inProgress.Metrics.IntegerOps++
+			inProgress.Metrics.MemoryWrites++
+			inProgress.Metrics.StackReads += 2
+		case ops.F32Store, ops.F64Store:
+			inProgress.Metrics.FloatOps++
+			inProgress.Metrics.MemoryWrites++
+			inProgress.Metrics.StackReads += 2
 		}
 		inProgress.Metrics.AllOps++
 	}
 
-	// End of instructions - emit the inProgress candidate if
-	// its at least 3 instructions.
-	if inProgress.Metrics.AllOps > 2 {
+	// End of instructions - emit the inProgress candidate if the policy
+	// judges it worth compiling.
+	if s.policy.selectCandidate(inProgress) {
 		finishedCandidates = append(finishedCandidates, inProgress)
 	}
 	return finishedCandidates, nil
@@ -0,0 +1,245 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compile
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	ops "github.com/go-interpreter/wagon/wasm/operators"
+)
+
+// opcodesBackendWouldSupport derives, from the real operator table itself
+// rather than from scanner.go's switch cases, the set of opcodes a real
+// backend would plausibly put in its supportedOpcodes set: get_local/
+// set_local, the const/compare/arithmetic family, and the load/store
+// family, identified by their WebAssembly text name rather than copied
+// byte constants. The operators package exports no way to range over the
+// whole table, so every byte value is probed through the exported
+// ops.New - any opcode that package grows which matches one of these
+// shapes is automatically picked up here, so
+// TestScanFuncAccountsForEverySupportedOpcode below catches drift instead
+// of relying on a hand-kept duplicate of the switch.
+func opcodesBackendWouldSupport() []byte {
+	arithmeticAndCompareSuffixes := []string{
+		".eqz",
+		".eq", ".ne",
+		".lt_u", ".gt_u", ".le_u", ".ge_u",
+		".lt", ".gt", ".le", ".ge",
+		".add", ".sub", ".mul",
+		".div_u", ".div_s", ".rem_u", ".rem_s", ".div",
+		".and", ".or", ".xor",
+		".shl", ".shr_u", ".shr_s",
+	}
+
+	var out []byte
+	for b := 0; b < 256; b++ {
+		op, err := ops.New(byte(b))
+		if err != nil {
+			continue
+		}
+		name := op.Name
+		switch {
+		case name == "get_local", name == "set_local":
+			out = append(out, byte(b))
+		case strings.HasSuffix(name, ".const"):
+			out = append(out, byte(b))
+		case strings.Contains(name, ".load"), strings.Contains(name, ".store"):
+			out = append(out, byte(b))
+		default:
+			for _, suffix := range arithmeticAndCompareSuffixes {
+				if strings.HasSuffix(name, suffix) {
+					out = append(out, byte(b))
+					break
+				}
+			}
+		}
+	}
+	return out
+}
+
+// TestScanFuncPolicyRejectsStackShuffling checks that a short run of pure
+// get_local/set_local traffic - the kind of sequence that costs more to call
+// into native code for than it saves - does not clear DefaultPolicy.
+func TestScanFuncPolicyRejectsStackShuffling(t *testing.T) {
+	supported := map[byte]bool{ops.GetLocal: true, ops.SetLocal: true}
+	s := NewScanner(supported, DefaultPolicy)
+
+	meta := &BytecodeMetadata{
+		Instructions: []InstructionMetadata{
+			{Op: ops.GetLocal, Start: 0, Size: 2},
+			{Op: ops.SetLocal, Start: 2, Size: 2},
+			{Op: ops.GetLocal, Start: 4, Size: 2},
+		},
+		InboundTargets: map[int64]struct{}{},
+	}
+
+	candidates, err := s.ScanFunc([]byte{0, 0, 0, 0, 0, 0}, meta)
+	if err != nil {
+		t.Fatalf("ScanFunc returned error: %v", err)
+	}
+	if len(candidates) != 0 {
+		t.Fatalf("expected get_local/set_local-only run to be rejected by DefaultPolicy, got %d candidates", len(candidates))
+	}
+}
+
+// TestScanFuncPolicyAcceptsArithmeticLoop checks that a tight run of integer
+// arithmetic - the kind of sequence where native code actually pays off -
+// clears DefaultPolicy.
+func TestScanFuncPolicyAcceptsArithmeticLoop(t *testing.T) {
+	supported := map[byte]bool{ops.GetLocal: true, ops.I64Add: true, ops.I64Mul: true, ops.SetLocal: true}
+	s := NewScanner(supported, DefaultPolicy)
+
+	meta := &BytecodeMetadata{
+		Instructions: []InstructionMetadata{
+			{Op: ops.GetLocal, Start: 0, Size: 2},
+			{Op: ops.GetLocal, Start: 2, Size: 2},
+			{Op: ops.I64Add, Start: 4, Size: 1},
+			{Op: ops.GetLocal, Start: 5, Size: 2},
+			{Op: ops.I64Mul, Start: 7, Size: 1},
+			{Op: ops.SetLocal, Start: 8, Size: 2},
+		},
+		InboundTargets: map[int64]struct{}{},
+	}
+
+	candidates, err := s.ScanFunc([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, meta)
+	if err != nil {
+		t.Fatalf("ScanFunc returned error: %v", err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("expected tight arithmetic loop to be accepted by DefaultPolicy, got %d candidates", len(candidates))
+	}
+}
+
+// TestScanFuncSplitsAtInboundTarget checks that a loop whose back-edge lands
+// inside an otherwise-contiguous run of supported opcodes is split into two
+// adjacent candidates at the target instruction, instead of being discarded.
+func TestScanFuncSplitsAtInboundTarget(t *testing.T) {
+	supported := map[byte]bool{ops.GetLocal: true, ops.SetLocal: true, ops.I64Add: true, ops.I64Mul: true}
+	s := NewScanner(supported, Policy{MinOps: 1})
+
+	// 0: get_local
+	// 2: get_local   <- loop header, targeted by the br_if at offset 8
+	// 4: i64.add
+	// 5: set_local
+	// 7: get_local
+	// 8: i64.mul     (stands in for a back-edge branch into offset 2)
+	meta := &BytecodeMetadata{
+		Instructions: []InstructionMetadata{
+			{Op: ops.GetLocal, Start: 0, Size: 2},
+			{Op: ops.GetLocal, Start: 2, Size: 2},
+			{Op: ops.I64Add, Start: 4, Size: 1},
+			{Op: ops.SetLocal, Start: 5, Size: 2},
+			{Op: ops.GetLocal, Start: 7, Size: 1},
+			{Op: ops.I64Mul, Start: 8, Size: 1},
+		},
+		InboundTargets: map[int64]struct{}{2: {}},
+	}
+
+	candidates, err := s.ScanFunc([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0}, meta)
+	if err != nil {
+		t.Fatalf("ScanFunc returned error: %v", err)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("expected the inbound target to split the run into 2 candidates, got %d", len(candidates))
+	}
+
+	first, second := candidates[0], candidates[1]
+	if first.Start != 0 || first.End != 2 {
+		t.Fatalf("expected first candidate to cover [0, 2), got [%d, %d)", first.Start, first.End)
+	}
+	if len(first.EntryOffsets) != 0 {
+		t.Fatalf("expected first candidate to have no entry offsets, got %v", first.EntryOffsets)
+	}
+	if second.Start != 2 {
+		t.Fatalf("expected second candidate to resume at the inbound target offset 2, got %d", second.Start)
+	}
+	if len(second.EntryOffsets) != 1 || second.EntryOffsets[0] != 2 {
+		t.Fatalf("expected second candidate to record entry offset [2], got %v", second.EntryOffsets)
+	}
+}
+
+// TestScanFuncRecordsEntryOffsetAfterUnsupportedReset checks the ordinary
+// wasm loop shape: an unsupported pseudo-op (stand-in for `loop`/`block`)
+// resets the in-progress candidate, and the very next instruction - the
+// loop header, which is also the target of the loop's back-edge - becomes
+// the first instruction of a fresh candidate. Unlike the mid-run split
+// covered by TestScanFuncSplitsAtInboundTarget, there is no candidate to
+// close here; the branch target offset must still end up in EntryOffsets.
+func TestScanFuncRecordsEntryOffsetAfterUnsupportedReset(t *testing.T) {
+	const unsupportedLoopOp = 0xfe // stands in for an unsupported loop/block pseudo-op
+	supported := map[byte]bool{ops.GetLocal: true, ops.I64Add: true, ops.SetLocal: true}
+	s := NewScanner(supported, Policy{MinOps: 1})
+
+	// 0: loop          (unsupported, resets any in-progress candidate)
+	// 1: get_local      <- loop header, targeted by a later back-edge
+	// 3: i64.add
+	// 4: set_local
+	meta := &BytecodeMetadata{
+		Instructions: []InstructionMetadata{
+			{Op: unsupportedLoopOp, Start: 0, Size: 1},
+			{Op: ops.GetLocal, Start: 1, Size: 2},
+			{Op: ops.I64Add, Start: 3, Size: 1},
+			{Op: ops.SetLocal, Start: 4, Size: 2},
+		},
+		InboundTargets: map[int64]struct{}{1: {}},
+	}
+
+	candidates, err := s.ScanFunc([]byte{unsupportedLoopOp, 0, 0, 0, 0, 0}, meta)
+	if err != nil {
+		t.Fatalf("ScanFunc returned error: %v", err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("expected a single candidate starting at the loop header, got %d", len(candidates))
+	}
+
+	c := candidates[0]
+	if c.Start != 1 {
+		t.Fatalf("expected candidate to start at the loop header offset 1, got %d", c.Start)
+	}
+	if len(c.EntryOffsets) != 1 || c.EntryOffsets[0] != 1 {
+		t.Fatalf("expected candidate to record entry offset [1] for its own branch-target start, got %v", c.EntryOffsets)
+	}
+}
+
+// TestScanFuncAccountsForEverySupportedOpcode guards against Metrics going
+// stale as backends grow: every opcode a backend claims to support via
+// supportedOpcodes must bump at least one of IntegerOps, FloatOps,
+// MemoryReads or MemoryWrites in ScanFunc, otherwise any cost/benefit heuristic built on top of Metrics
+// would be blind to it.
+func TestScanFuncAccountsForEverySupportedOpcode(t *testing.T) {
+	for _, op := range opcodesBackendWouldSupport() {
+		op := op
+		t.Run(fmt.Sprintf("opcode_0x%02x", op), func(t *testing.T) {
+			s := &scanner{supportedOpcodes: map[byte]bool{op: true}}
+			// Three identical instructions, just to exercise a
+			// multi-instruction run rather than a single opcode in
+			// isolation; the zero-value Policy accepts it regardless.
+			meta := &BytecodeMetadata{
+				Instructions: []InstructionMetadata{
+					{Op: op, Start: 0, Size: 1},
+					{Op: op, Start: 1, Size: 1},
+					{Op: op, Start: 2, Size: 1},
+				},
+				InboundTargets: map[int64]struct{}{},
+			}
+
+			candidates, err := s.ScanFunc([]byte{op, op, op}, meta)
+			if err != nil {
+				t.Fatalf("ScanFunc returned error: %v", err)
+			}
+			if len(candidates) != 1 {
+				t.Fatalf("expected a single candidate for a 3-instruction run of opcode 0x%02x, got %d", op, len(candidates))
+			}
+
+			m := candidates[0].Metrics
+			accounted := m.IntegerOps + m.FloatOps + int(m.MemoryReads) + int(m.MemoryWrites)
+			if accounted == 0 {
+				t.Fatalf("opcode 0x%02x is marked as supported but is not accounted for by IntegerOps, FloatOps, MemoryReads or MemoryWrites in ScanFunc's switch", op)
+			}
+		})
+	}
+}